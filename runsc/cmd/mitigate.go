@@ -30,16 +30,63 @@ import (
 const (
 	// cpuInfo is the path used to parse CPU info.
 	cpuInfo = "/proc/cpuinfo"
-	// Path to shutdown a CPU.
-	smtPath = "/sys/devices/system/cpu/smt/control"
+	// sysfsRoot is the root of the sysfs tree mitigate reads and writes
+	// under. Tests pass a temp directory to doExecute in its place so
+	// strategies can be exercised without touching the real sysfs.
+	sysfsRoot = "/sys"
+	// Path to shutdown a CPU, relative to sysfsRoot.
+	smtPathSuffix = "/devices/system/cpu/smt/control"
 )
 
+// strategy names accepted by the --strategy flag.
+const (
+	// strategySMTOff disables SMT entirely, the original mitigate
+	// behavior.
+	strategySMTOff = "smt-off"
+	// strategyOfflineSiblings offlines one sibling thread of every
+	// vulnerable physical core, leaving non-vulnerable cores untouched.
+	strategyOfflineSiblings = "offline-siblings"
+	// strategyKernelControls writes the recommended mitigation values to
+	// the vulnerability-specific sysfs knobs for the bugs the detected
+	// microarch is known to have.
+	strategyKernelControls = "kernel-controls"
+)
+
+// bugControls maps a known vulnerability name to the sysfs files (relative
+// to sysfsRoot) that should be set to mitigate it, and the value to set
+// them to.
+var bugControls = map[string][]sysfsControl{
+	"mds":             {{"/devices/system/cpu/vulnerabilities/mds", "Mitigation: Clear CPU buffers", "Vulnerable"}, {"/kernel/mm/ksm/run", "0", "1"}},
+	"l1tf":            {{"/devices/system/cpu/vulnerabilities/l1tf", "Mitigation: PTE Inversion", "Vulnerable"}, {"/kernel/mm/ksm/run", "0", "1"}},
+	"taa":             {{"/devices/system/cpu/vulnerabilities/tsx_async_abort", "Mitigation: Clear CPU buffers", "Vulnerable"}},
+	"srbds":           {{"/devices/system/cpu/vulnerabilities/srbds", "Mitigation: Microcode", "Vulnerable"}},
+	"mmio_stale_data": {{"/devices/system/cpu/vulnerabilities/mmio_stale_data", "Mitigation: Clear CPU buffers", "Vulnerable"}},
+	"retbleed":        {{"/devices/system/cpu/vulnerabilities/retbleed", "Mitigation: IBPB", "Vulnerable"}},
+}
+
+// sysfsControl is a single sysfs file/value pair written to apply or
+// reverse a kernel-controls mitigation.
+type sysfsControl struct {
+	// path is relative to sysfsRoot.
+	path string
+	// onValue is the value written to mitigate the bug.
+	onValue string
+	// offValue is the value written to restore the knob's prior,
+	// unmitigated state. It is knob-specific: most vulnerability files
+	// just report "Vulnerable", but real tunables like ksm/run only ever
+	// take small integers.
+	offValue string
+}
+
 // Mitigate implements subcommands.Command for the "mitigate" command.
 type Mitigate struct {
 	// Run the command without changing the underlying system.
 	dryRun bool
 	// Reverse mitigate by turning on all CPU cores.
 	reverse bool
+	// strategy selects which mitigation is applied. See the strategy*
+	// constants above.
+	strategy string
 	// Extra data for post mitigate operations.
 	data string
 }
@@ -60,13 +107,16 @@ func (m Mitigate) Usage() string {
 
 mitigate mitigates a system to the "MDS" vulnerability by writing "off" to /sys/devices/system/cpu/smt/control. CPUs can be restored by writing "on" to the same file or rebooting your system.
 
-The command can be reversed with --reverse, which writes "off" to the file above.%s`, m.usage())
+The command can be reversed with --reverse, which writes "on" to the file above.
+
+--strategy selects the mitigation applied: "smt-off" (default) disables SMT entirely, "offline-siblings" offlines one sibling thread per vulnerable physical core, and "kernel-controls" sets the sysfs knobs recommended for the bugs the detected microarch has.%s`, m.usage())
 }
 
 // SetFlags sets flags for the command Mitigate.
 func (m *Mitigate) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&m.dryRun, "dryrun", false, "run the command without changing system")
 	f.BoolVar(&m.reverse, "reverse", false, "reverse mitigate by enabling all CPUs")
+	f.StringVar(&m.strategy, "strategy", strategySMTOff, "mitigation strategy to apply: smt-off, offline-siblings, or kernel-controls")
 	m.setFlags(f)
 }
 
@@ -81,19 +131,24 @@ func (m *Mitigate) Execute(_ context.Context, f *flag.FlagSet, args ...interface
 		f.Usage()
 		return subcommands.ExitUsageError
 	}
-	return m.doExecute(cpuInfo, smtPath)
+	return m.doExecute(cpuInfo, sysfsRoot)
 }
 
-func (m *Mitigate) doExecute(cpuInfoPath, smtFilePath string) subcommands.ExitStatus {
+func (m *Mitigate) doExecute(cpuInfoPath, sysfsRootPath string) subcommands.ExitStatus {
 	beforeSet, err := getCPUSet(cpuInfoPath)
 	if err != nil {
 		return Errorf("Get before CPUSet failed: %v", err)
 	}
 	log.Infof("CPUs before: %s", beforeSet.String())
 
-	action := doMitigate
+	mitigateFn, reverseFn, err := strategyFuncs(m.strategy)
+	if err != nil {
+		return Errorf("Invalid strategy: %v", err)
+	}
+
+	action := mitigateFn
 	if m.reverse {
-		action = doReverse
+		action = reverseFn
 	}
 
 	// dryRun should skip any mitigate action.
@@ -103,7 +158,7 @@ func (m *Mitigate) doExecute(cpuInfoPath, smtFilePath string) subcommands.ExitSt
 		}
 	}
 
-	if err := action(smtFilePath, beforeSet); err != nil {
+	if err := action(sysfsRootPath, beforeSet); err != nil {
 		return Errorf("Action failed: %v", err)
 	}
 	afterSet, err := getCPUSet(cpuInfoPath)
@@ -119,6 +174,25 @@ func (m *Mitigate) doExecute(cpuInfoPath, smtFilePath string) subcommands.ExitSt
 	return subcommands.ExitSuccess
 }
 
+// mitigateAction applies or reverses a mitigation strategy against the
+// sysfs tree rooted at sysfsRootPath.
+type mitigateAction func(sysfsRootPath string, cpuSet mitigate.CPUSet) error
+
+// strategyFuncs returns the mitigate and reverse actions for the named
+// strategy.
+func strategyFuncs(strategy string) (mitigateAction, mitigateAction, error) {
+	switch strategy {
+	case "", strategySMTOff:
+		return doMitigate, doReverse, nil
+	case strategyOfflineSiblings:
+		return doOfflineSiblings, doOnlineSiblings, nil
+	case strategyKernelControls:
+		return doKernelControls, doReverseKernelControls, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+}
+
 // getCPUSet gets the current CPUSet and prints it.
 func getCPUSet(path string) (mitigate.CPUSet, error) {
 	data, err := ioutil.ReadFile(path)
@@ -129,31 +203,109 @@ func getCPUSet(path string) (mitigate.CPUSet, error) {
 }
 
 // doMitigate turns off SMT by writing "off" to /sys/devices/cpu/smt/control.
-func doMitigate(filePath string, cpuSet mitigate.CPUSet) error {
+func doMitigate(sysfsRootPath string, cpuSet mitigate.CPUSet) error {
 	if !cpuSet.IsVulnerable() {
 		return nil
 	}
-	if err := doEnableDisable(filePath, "off"); err != nil {
+	if err := doEnableDisable(sysfsRootPath+smtPathSuffix, "off"); err != nil {
 		return fmt.Errorf("disable: %v", err)
 	}
 	return nil
 }
 
 // doReverse turns on the SMT by writing "on" to /sys/devices/cpu/smt/control.
-func doReverse(filePath string, _ mitigate.CPUSet) error {
-	if err := doEnableDisable(filePath, "on"); err != nil {
+func doReverse(sysfsRootPath string, _ mitigate.CPUSet) error {
+	if err := doEnableDisable(sysfsRootPath+smtPathSuffix, "on"); err != nil {
 		return fmt.Errorf("enable: %v", err)
 	}
 	return nil
 }
 
+// doOfflineSiblings offlines one sibling thread of every physical core in
+// cpuSet, leaving non-vulnerable cores untouched. Unlike doMitigate, this
+// only disables SMT on the cores that actually need it.
+func doOfflineSiblings(sysfsRootPath string, cpuSet mitigate.CPUSet) error {
+	if !cpuSet.IsVulnerable() {
+		return nil
+	}
+	for _, pair := range cpuSet.ThreadPairs() {
+		if len(pair) < 2 {
+			continue
+		}
+		for _, cpu := range pair[1:] {
+			if err := doEnableDisable(onlinePath(sysfsRootPath, cpu), "0"); err != nil {
+				return fmt.Errorf("offline cpu%d: %v", cpu, err)
+			}
+		}
+	}
+	return nil
+}
+
+// doOnlineSiblings reverses doOfflineSiblings by bringing every sibling
+// thread back online, regardless of vulnerability, mirroring how
+// doReverse unconditionally re-enables SMT.
+func doOnlineSiblings(sysfsRootPath string, cpuSet mitigate.CPUSet) error {
+	for _, pair := range cpuSet.ThreadPairs() {
+		if len(pair) < 2 {
+			continue
+		}
+		for _, cpu := range pair[1:] {
+			if err := doEnableDisable(onlinePath(sysfsRootPath, cpu), "1"); err != nil {
+				return fmt.Errorf("online cpu%d: %v", cpu, err)
+			}
+		}
+	}
+	return nil
+}
+
+// doKernelControls writes the recommended mitigation value to the sysfs
+// knobs for every bug the detected microarch is known to have.
+func doKernelControls(sysfsRootPath string, cpuSet mitigate.CPUSet) error {
+	if !cpuSet.IsVulnerable() {
+		return nil
+	}
+	for _, bug := range cpuSet.Bugs() {
+		for _, ctrl := range bugControls[bug] {
+			if err := doEnableDisable(sysfsRootPath+ctrl.path, ctrl.onValue); err != nil {
+				return fmt.Errorf("apply %s control: %v", bug, err)
+			}
+		}
+	}
+	return nil
+}
+
+// doReverseKernelControls restores the sysfs knobs doKernelControls set to
+// their unmitigated defaults.
+func doReverseKernelControls(sysfsRootPath string, cpuSet mitigate.CPUSet) error {
+	for _, bug := range cpuSet.Bugs() {
+		for _, ctrl := range bugControls[bug] {
+			if err := doEnableDisable(sysfsRootPath+ctrl.path, ctrl.offValue); err != nil {
+				return fmt.Errorf("reverse %s control: %v", bug, err)
+			}
+		}
+	}
+	return nil
+}
+
+// onlinePath returns the sysfs path controlling whether the given logical
+// CPU is online.
+func onlinePath(sysfsRootPath string, cpu int) string {
+	return fmt.Sprintf("%s/devices/system/cpu/cpu%d/online", sysfsRootPath, cpu)
+}
+
 func doEnableDisable(filePath, action string) error {
 	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %v", smtPath, err)
+		return fmt.Errorf("failed to open file %s: %v", filePath, err)
+	}
+	defer f.Close()
+	// Truncate so a shorter value (e.g. "on" after "off") does not leave
+	// the tail of the previous contents behind.
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate %s: %v", filePath, err)
 	}
 	if _, err = f.Write([]byte(action)); err != nil {
-		return fmt.Errorf("failed to write \"%s\" to %s: %v", action, smtPath, err)
+		return fmt.Errorf("failed to write \"%s\" to %s: %v", action, filePath, err)
 	}
 	return nil
 }
@@ -18,125 +18,164 @@
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/subcommands"
 	"gvisor.dev/gvisor/runsc/mitigate/mock"
 )
 
-type executeTestCase struct {
-	name                   string
-	mitigateData           string
-	mitigateError          subcommands.ExitStatus
-	mitigateExpectedOutput string
-	reverseData            string
-	reverseError           subcommands.ExitStatus
-	reverseExpectedOutput  string
+// writeSysfsTree builds a temp directory laid out like the sysfs paths
+// mitigate reads and writes, pre-populated with "on"/unmitigated defaults
+// for every logical CPU in cpu, and returns its root.
+func writeSysfsTree(t *testing.T, cpu mock.CPU) string {
+	t.Helper()
+	root := t.TempDir()
+
+	writeFile(t, filepath.Join(root, "devices/system/cpu/smt/control"), "on")
+	for i := 0; i < cpu.NumCPUs(); i++ {
+		writeFile(t, filepath.Join(root, "devices/system/cpu", fmt.Sprintf("cpu%d", i), "online"), "1")
+	}
+	for _, bug := range []string{"mds", "l1tf", "tsx_async_abort", "srbds", "mmio_stale_data", "retbleed"} {
+		writeFile(t, filepath.Join(root, "devices/system/cpu/vulnerabilities", bug), "Vulnerable")
+	}
+	writeFile(t, filepath.Join(root, "kernel/mm/ksm/run"), "1")
+	return root
 }
 
-func TestExecute(t *testing.T) {
-
-	partial := `processor       : 1
-vendor_id       : AuthenticAMD
-cpu family      : 23
-model           : 49
-model name      : AMD EPYC 7B12
-physical id     : 0
-bugs         : sysret_ss_attrs spectre_v1 spectre_v2 spec_store_bypass
-power management:
-`
-
-	for _, tc := range []executeTestCase{
-		{
-			name:                   "CascadeLake4",
-			mitigateData:           mock.CascadeLake4.MakeMitigatedCPUString(),
-			mitigateExpectedOutput: "off",
-			reverseData:            mock.CascadeLake4.MakeCPUString(),
-			reverseExpectedOutput:  "on",
-		},
-		{
-			name:          "Empty",
-			mitigateData:  "",
-			mitigateError: Errorf(`mitigate operation failed: no cpus found for: ""`),
-			reverseData:   "somethingNotCPU",
-			reverseError:  Errorf(`mitigate operation failed: no cpus found for: ""`),
-		},
-		{
-			name: "Partial",
-			mitigateData: `processor       : 0
-vendor_id       : AuthenticAMD
-cpu family      : 23
-model           : 49
-model name      : AMD EPYC 7B12
-physical id     : 0
-core id         : 0
-cpu cores       : 1
-bugs            : sysret_ss_attrs spectre_v1 spectre_v2 spec_store_bypass
-power management::84
-
-` + partial,
-			mitigateError: Errorf(`mitigate operation failed: failed to match key "core id": %q`, partial),
-			reverseError:  Errorf(`reverse operation failed: mismatch regex from possible: %q`, "1-"),
-		},
-	} {
-		t.Run(tc.name, func(t *testing.T) {
-			m := &Mitigate{}
-			t.Run("Mitigate", func(t *testing.T) {
-				m.doExecuteTest(t, tc.mitigateData, tc.mitigateExpectedOutput, tc.mitigateError)
-			})
-
-			if tc.reverseData == "" {
-				tc.reverseData = tc.mitigateData
-			}
-			m.reverse = true
-			t.Run("Reverse", func(t *testing.T) {
-				m.doExecuteTest(t, tc.reverseData, tc.reverseExpectedOutput, tc.reverseError)
-			})
-		})
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
 	}
 }
 
-// doExecuteTest runs Execute with the mitigate operation and reverse operation.
-func (m *Mitigate) doExecuteTest(t *testing.T, data, wantSmt string, wantErr subcommands.ExitStatus) {
-	cpuInfo, err := ioutil.TempFile("", "cpuInfo.txt")
+// readFile returns the contents of path, failing the test if it can't be
+// read.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		t.Fatalf("Failed to create tmpfile: %v", err)
+		t.Fatalf("failed to read %s: %v", path, err)
 	}
-	defer os.Remove(cpuInfo.Name())
+	return string(data)
+}
 
-	if _, err := cpuInfo.WriteString(data); err != nil {
-		t.Fatalf("Failed to write to file: %v", err)
+// wantFile asserts that the file at path contains want.
+func wantFile(t *testing.T, path, want string) {
+	t.Helper()
+	if got := readFile(t, path); got != want {
+		t.Errorf("%s: got %q, want %q", path, got, want)
 	}
+}
 
-	smtFile, err := ioutil.TempFile("", "smt.txt")
+func writeCPUInfo(t *testing.T, data string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "cpuInfo.txt")
 	if err != nil {
 		t.Fatalf("Failed to create tmpfile: %v", err)
 	}
-	defer os.Remove(smtFile.Name())
-
-	if _, err := smtFile.WriteString("on"); err != nil {
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
 		t.Fatalf("Failed to write to file: %v", err)
 	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
 
-	subError := m.doExecute(cpuInfo.Name(), smtFile.Name())
-	if subError != wantErr {
-		t.Fatalf("Mitigate error mismatch: want: %v got: %v", wantErr, subError)
+// TestStrategies exercises every strategy's mitigate and reverse actions
+// against every mock CPU using a temp sysfs tree.
+func TestStrategies(t *testing.T) {
+	for _, cpu := range []mock.CPU{mock.CascadeLake2, mock.CascadeLake4, mock.Haswell2, mock.Haswell2core, mock.AMD2, mock.AMD8} {
+		cpu := cpu
+		t.Run(cpu.Name, func(t *testing.T) {
+			for _, strategy := range []string{strategySMTOff, strategyOfflineSiblings, strategyKernelControls} {
+				strategy := strategy
+				t.Run(strategy, func(t *testing.T) {
+					sysfsRootPath := writeSysfsTree(t, cpu)
+					cpuInfoPath := writeCPUInfo(t, cpu.MakeCPUString())
+					smtPath := filepath.Join(sysfsRootPath, "devices/system/cpu/smt/control")
+					siblingPath := filepath.Join(sysfsRootPath, "devices/system/cpu/cpu1/online")
+					ksmPath := filepath.Join(sysfsRootPath, "kernel/mm/ksm/run")
+
+					// Derive expectations from the mock CPU's own static
+					// characteristics, so each strategy is actually
+					// exercised against the distinct behavior of every
+					// mock CPU rather than one path they all share.
+					vulnerable := cpu.IsVulnerable
+					hasKSMBug := strings.Contains(cpu.Bugs, "mds") || strings.Contains(cpu.Bugs, "l1tf")
+
+					m := &Mitigate{strategy: strategy}
+					if status := m.doExecute(cpuInfoPath, sysfsRootPath); status != subcommands.ExitSuccess {
+						t.Fatalf("mitigate with strategy %s failed: %v", strategy, status)
+					}
+					switch strategy {
+					case strategySMTOff:
+						want := "on"
+						if vulnerable {
+							want = "off"
+						}
+						wantFile(t, smtPath, want)
+					case strategyOfflineSiblings:
+						want := "1"
+						if vulnerable && cpu.ThreadsPerCore > 1 {
+							want = "0"
+						}
+						wantFile(t, siblingPath, want)
+					case strategyKernelControls:
+						want := "1"
+						if vulnerable && hasKSMBug {
+							want = "0"
+						}
+						wantFile(t, ksmPath, want)
+					}
+
+					m.reverse = true
+					if status := m.doExecute(cpuInfoPath, sysfsRootPath); status != subcommands.ExitSuccess {
+						t.Fatalf("reverse with strategy %s failed: %v", strategy, status)
+					}
+					switch strategy {
+					case strategySMTOff:
+						wantFile(t, smtPath, "on")
+					case strategyOfflineSiblings:
+						wantFile(t, siblingPath, "1")
+					case strategyKernelControls:
+						wantFile(t, ksmPath, "1")
+					}
+				})
+			}
+		})
 	}
+}
 
-	// case where test should end in error or we don't care
-	// about how many cpus are returned.
-	if wantErr != subcommands.ExitSuccess {
-		return
-	}
+// TestStrategiesRejectsUnknownName checks that an unrecognized --strategy
+// value is rejected instead of silently falling back to smt-off.
+func TestStrategiesRejectsUnknownName(t *testing.T) {
+	cpu := mock.CascadeLake4
+	sysfsRootPath := writeSysfsTree(t, cpu)
+	cpuInfoPath := writeCPUInfo(t, cpu.MakeCPUString())
 
-	got, err := ioutil.ReadFile(smtFile.Name())
-	if err != nil {
-		t.Fatalf("Failed to read to file: %v", err)
+	m := &Mitigate{strategy: "not-a-real-strategy"}
+	if status := m.doExecute(cpuInfoPath, sysfsRootPath); status == subcommands.ExitSuccess {
+		t.Fatal("doExecute succeeded with an unknown strategy, want failure")
 	}
+}
+
+// TestExecuteInvalidCPUInfo checks that malformed /proc/cpuinfo data fails
+// doExecute with an error rather than silently mitigating nothing.
+func TestExecuteInvalidCPUInfo(t *testing.T) {
+	sysfsRootPath := writeSysfsTree(t, mock.CascadeLake4)
+	cpuInfoPath := writeCPUInfo(t, "")
 
-	if string(got) != wantSmt {
-		t.Fatalf("Want smt file: want %s got: %s", wantSmt, got)
+	m := &Mitigate{}
+	if status := m.doExecute(cpuInfoPath, sysfsRootPath); status == subcommands.ExitSuccess {
+		t.Fatal("doExecute succeeded with empty /proc/cpuinfo, want failure")
 	}
 }
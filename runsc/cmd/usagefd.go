@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/subcommands"
 	"gvisor.dev/gvisor/runsc/config"
@@ -23,8 +24,22 @@ import (
 	"gvisor.dev/gvisor/runsc/flag"
 )
 
+// usageFDFormatText is the original, single-shot output format: a
+// human-readable snapshot of memory usage.
+const usageFDFormatText = "text"
+
+// usageFDFormatOpenMetrics streams sandbox metrics in Prometheus text
+// exposition / OpenMetrics format, one sample every --interval.
+const usageFDFormatOpenMetrics = "openmetrics"
+
 // UsageFD implements subcommands.Command for the "usagefd" command.
-type UsageFD struct{}
+type UsageFD struct {
+	// format is the output format: "text" or "openmetrics".
+	format string
+	// interval is how often a new sample is emitted when format is
+	// "openmetrics". Zero means emit a single sample and exit.
+	interval time.Duration
+}
 
 // Name implements subcommands.Command.Name.
 func (*UsageFD) Name() string {
@@ -38,11 +53,20 @@ func (*UsageFD) Synopsis() string {
 
 // Usage implements subcommands.Command.Usage.
 func (*UsageFD) Usage() string {
-	return `UsageFD <container id> - read memory usage using two donated FDs and print to standard output.`
+	return `UsageFD <container id> - read memory usage using two donated FDs and print to standard output.
+
+By default, a single snapshot is printed. With --format=openmetrics, one
+donated FD is used as a control socket and the other as a writable stream;
+sandbox metrics (memory, total CPU time with no per-cgroup breakdown, sentry
+goroutine count, gofer I/O, and network device counters) are emitted in Prometheus text exposition /
+OpenMetrics format every --interval, so a sidecar can "cat" the FD into an
+HTTP /metrics handler.`
 }
 
 // SetFlags implements subcommands.Command.SetFlags.
-func (c *UsageFD) SetFlags(*flag.FlagSet) {
+func (c *UsageFD) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.format, "format", usageFDFormatText, `output format: "text" (single snapshot) or "openmetrics" (streaming)`)
+	f.DurationVar(&c.interval, "interval", 0, "with --format=openmetrics, how often to emit a new sample")
 }
 
 // Execute implements subcommands.Command.Execute.
@@ -60,8 +84,20 @@ func (c *UsageFD) Execute(_ context.Context, f *flag.FlagSet, args ...interface{
 		Fatalf("loading container: %v", err)
 	}
 
-	if err := cont.UsageFD(); err != nil {
-		Fatalf("cat failed: %v", err)
+	switch c.format {
+	case usageFDFormatText:
+		if c.interval != 0 {
+			Fatalf("--interval is only valid with --format=%s", usageFDFormatOpenMetrics)
+		}
+		if err := cont.UsageFD(); err != nil {
+			Fatalf("cat failed: %v", err)
+		}
+	case usageFDFormatOpenMetrics:
+		if err := cont.UsageFDStream(container.UsageFDStreamOpts{Interval: c.interval}); err != nil {
+			Fatalf("stream failed: %v", err)
+		}
+	default:
+		Fatalf("unknown --format %q", c.format)
 	}
 
 	return subcommands.ExitSuccess
@@ -0,0 +1,165 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/seccomp"
+)
+
+// maxSyscallArgs is the number of argument registers a syscall event
+// carries, matching the Linux syscall ABI's six argument registers.
+const maxSyscallArgs = 6
+
+// constantArgSyscalls lists the syscalls, and the argument indices within
+// them, that RecordSyscalls tracks for constant-value comparators: the
+// socket domain/type/protocol triple and the prctl option, which are the
+// arguments a hardened profile can usefully pin without risking a false
+// ERRNO on a legitimate, differently-parameterized call.
+var constantArgSyscalls = map[string][]int{
+	"socket": {0, 1, 2},
+	"prctl":  {0},
+}
+
+// syscallObservation tracks whether a single argument register has taken
+// the same value on every invocation seen so far.
+type syscallObservation struct {
+	seen       bool
+	value      uint64
+	consistent bool
+}
+
+// syscallRecord accumulates what's been observed for one syscall number:
+// that it was called at all, and whether each of its argument registers
+// has been constant.
+type syscallRecord struct {
+	args [maxSyscallArgs]syscallObservation
+}
+
+// observe folds one invocation's argument values into the record.
+func (r *syscallRecord) observe(args [maxSyscallArgs]uint64) {
+	for i, v := range args {
+		a := &r.args[i]
+		if !a.seen {
+			a.seen = true
+			a.value = v
+			a.consistent = true
+			continue
+		}
+		if a.value != v {
+			a.consistent = false
+		}
+	}
+}
+
+// syscallRecorder is the per-observation-window state RecordSyscalls
+// builds up from the sentry's syscall-entry events. The audit hook fires
+// once per syscall on whichever guest thread made it, so observe and
+// results are synchronized against concurrent callbacks.
+type syscallRecorder struct {
+	mu      sync.Mutex
+	records map[uintptr]*syscallRecord
+}
+
+// newSyscallRecorder returns an empty recorder.
+func newSyscallRecorder() *syscallRecorder {
+	return &syscallRecorder{records: make(map[uintptr]*syscallRecord)}
+}
+
+// observe records one syscall invocation: sysno and its first
+// maxSyscallArgs argument register values.
+func (s *syscallRecorder) observe(sysno uintptr, args [maxSyscallArgs]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[sysno]
+	if !ok {
+		rec = &syscallRecord{}
+		s.records[sysno] = rec
+	}
+	rec.observe(args)
+}
+
+// results returns the distinct syscall numbers observed, and, for the
+// syscalls and argument indices listed in constantArgSyscalls, the
+// seccomp.Arg comparator to pin the generated profile to if that argument
+// was constant across every observed invocation.
+func (s *syscallRecorder) results() ([]uintptr, map[uintptr][]seccomp.Arg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var nums []uintptr
+	argVals := map[uintptr][]seccomp.Arg{}
+	for sysno, rec := range s.records {
+		nums = append(nums, sysno)
+
+		name, err := seccomp.SyscallName(int(sysno))
+		if err != nil {
+			continue
+		}
+		indices, ok := constantArgSyscalls[name]
+		if !ok {
+			continue
+		}
+		for _, i := range indices {
+			a := rec.args[i]
+			if !a.seen || !a.consistent {
+				continue
+			}
+			argVals[sysno] = append(argVals[sysno], seccomp.Arg{
+				Index: uint(i),
+				Op:    seccomp.EQ,
+				Value: a.value,
+			})
+		}
+	}
+	return nums, argVals
+}
+
+// RecordSyscalls observes the container's sentry process for duration,
+// turning the sentry's per-syscall strace/audit hook into a lightweight
+// counter instead of a full trace log. It returns the distinct syscall
+// numbers invoked and, for a handful of security-relevant syscalls (see
+// constantArgSyscalls), the comparators seccomp-gen needs to pin the
+// generated profile to the constant argument values actually used.
+//
+// If ctx is canceled before duration elapses, RecordSyscalls stops early
+// and returns whatever was recorded up to that point, along with ctx's
+// error, rather than discarding the observation window.
+func (c *Container) RecordSyscalls(ctx context.Context, duration time.Duration) ([]uintptr, map[uintptr][]seccomp.Arg, error) {
+	recorder := newSyscallRecorder()
+
+	stop, err := c.Sandbox.StartSyscallAudit(func(sysno uintptr, args [maxSyscallArgs]uint64) {
+		recorder.observe(sysno, args)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("starting syscall audit: %w", err)
+	}
+	defer stop()
+
+	var ctxErr error
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	case <-timer.C:
+	}
+
+	nums, argVals := recorder.results()
+	return nums, argVals, ctxErr
+}
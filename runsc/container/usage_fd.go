@@ -0,0 +1,249 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/log"
+)
+
+// UsageFDStreamOpts configures UsageFDStream.
+type UsageFDStreamOpts struct {
+	// Interval is how often a new sample is written to the stream FD.
+	// Zero means emit a single sample and return.
+	Interval time.Duration
+}
+
+// usageFDControlFD and usageFDStreamFD are the well-known descriptor
+// numbers "runsc usagefd" donates to the process: fd 3 is a control
+// socket the caller closes to ask the stream to stop (data written to it
+// is ignored), and fd 4 is the stream the samples are written to.
+const (
+	usageFDControlFD = 3
+	usageFDStreamFD  = 4
+)
+
+// usageFDMetric is a single OpenMetrics sample: a flat counter or gauge
+// plus the label set (if any) that distinguishes it from other series
+// under the same metric name (e.g. one "network_rx_bytes_total" series per
+// interface).
+type usageFDMetric struct {
+	// name is the OpenMetrics metric name, e.g. "sentry_memory_usage_bytes".
+	name string
+	// help is the single-line description written in the metric's HELP
+	// comment.
+	help string
+	// metricType is "counter" or "gauge".
+	metricType string
+	// labels are the label name/value pairs for this series, e.g.
+	// {"device": "eth0"}. May be empty.
+	labels map[string]string
+	// value is the current sample value.
+	value float64
+}
+
+// counterState tracks a single cumulative counter's last raw reading and
+// the offset accumulated from earlier sandbox restarts, so the value
+// reported to the caller keeps climbing across a restart instead of
+// dropping back to zero, as OpenMetrics/Prometheus counters require.
+type counterState struct {
+	lastRaw float64
+	offset  float64
+}
+
+// usageFDCollector gathers the fixed set of series UsageFDStream reports:
+// sentry memory usage, total sandbox CPU time, sentry goroutine count,
+// gofer I/O bytes, and per-interface network device counters. CPU time is
+// a single series; it is not broken down per cgroup.
+type usageFDCollector struct {
+	cont *Container
+
+	// sawRestart is set once the sandbox has restarted at least once,
+	// purely so the first restart is logged and later ones aren't.
+	sawRestart bool
+	// counters holds the running state for every counter metric this
+	// collector has reported, keyed by seriesKey.
+	counters map[string]counterState
+}
+
+// newUsageFDCollector creates a collector for cont.
+func newUsageFDCollector(cont *Container) *usageFDCollector {
+	return &usageFDCollector{
+		cont:     cont,
+		counters: make(map[string]counterState),
+	}
+}
+
+// seriesKey returns the key usageFDCollector uses to track a metric's
+// counter baseline across sandbox restarts.
+func seriesKey(name string, labels map[string]string) string {
+	key := name
+	for k, v := range labels {
+		key += "," + k + "=" + v
+	}
+	return key
+}
+
+// collect reads a fresh set of samples from the sandbox, adjusting
+// cumulative counters for any restart that has happened since the last
+// call.
+func (u *usageFDCollector) collect() ([]usageFDMetric, error) {
+	usage, err := u.cont.Sandbox.SentryUsage()
+	if err != nil {
+		return nil, fmt.Errorf("reading sandbox usage: %w", err)
+	}
+
+	metrics := []usageFDMetric{
+		{
+			name:       "sentry_memory_usage_bytes",
+			help:       "Current sentry-reported memory usage of the sandboxed application, in bytes.",
+			metricType: "gauge",
+			value:      float64(usage.MemoryUsageBytes),
+		},
+		{
+			name:       "sentry_goroutines",
+			help:       "Number of goroutines running inside the sentry process.",
+			metricType: "gauge",
+			value:      float64(usage.Goroutines),
+		},
+		u.counter("sentry_cpu_seconds_total", "Cumulative CPU time consumed by the sandboxed application, in seconds.", nil, usage.CPUTime.Seconds()),
+		u.counter("gofer_io_bytes_total", "Cumulative bytes transferred between the sentry and the gofer.", nil, float64(usage.GoferIOBytes)),
+	}
+	// Built as two passes, rather than one rx/tx pair per device, so
+	// that all of one metric family's samples stay contiguous in the
+	// output: OpenMetrics requires every sample for a metric name to be
+	// grouped under its single HELP/TYPE block.
+	var rx, tx []usageFDMetric
+	for _, dev := range usage.NetworkDevices {
+		labels := map[string]string{"device": dev.Name}
+		rx = append(rx, u.counter("network_rx_bytes_total", "Cumulative bytes received on a sandbox network device.", labels, float64(dev.RxBytes)))
+		tx = append(tx, u.counter("network_tx_bytes_total", "Cumulative bytes transmitted on a sandbox network device.", labels, float64(dev.TxBytes)))
+	}
+	metrics = append(metrics, rx...)
+	metrics = append(metrics, tx...)
+	return metrics, nil
+}
+
+// counter builds a cumulative-counter sample for raw, folding the last
+// reading into this series' offset whenever raw has gone backwards (the
+// sentry process restarted and its in-process counter reset to zero).
+func (u *usageFDCollector) counter(name, help string, labels map[string]string, raw float64) usageFDMetric {
+	key := seriesKey(name, labels)
+	st := u.counters[key]
+	if raw < st.lastRaw {
+		if !u.sawRestart {
+			log.Infof("usagefd: sandbox %s counter %s went backwards, assuming restart", u.cont.ID, name)
+			u.sawRestart = true
+		}
+		st.offset += st.lastRaw
+	}
+	st.lastRaw = raw
+	u.counters[key] = st
+	return usageFDMetric{name: name, help: help, metricType: "counter", labels: labels, value: st.offset + raw}
+}
+
+// UsageFDStream streams sandbox metrics in Prometheus text exposition /
+// OpenMetrics format to a donated stream FD, one sample every
+// opts.Interval (or a single sample if opts.Interval is zero). The donated
+// control FD is watched for EOF so the caller can stop the stream by
+// closing its end.
+func (c *Container) UsageFDStream(opts UsageFDStreamOpts) error {
+	control := os.NewFile(usageFDControlFD, "usagefd-control")
+	defer control.Close()
+	stream := os.NewFile(usageFDStreamFD, "usagefd-stream")
+	defer stream.Close()
+
+	collector := newUsageFDCollector(c)
+	stopped := make(chan struct{})
+	go func() {
+		// The control socket carries no data; its only use is to
+		// signal "stop" by reaching EOF when the caller closes it.
+		buf := make([]byte, 1)
+		for {
+			if _, err := control.Read(buf); err != nil {
+				close(stopped)
+				return
+			}
+		}
+	}()
+
+	if err := writeSample(stream, collector); err != nil {
+		return err
+	}
+	if opts.Interval == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return nil
+		case <-ticker.C:
+			if err := writeSample(stream, collector); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeSample collects one round of metrics and writes it to w as an
+// OpenMetrics text exposition block: a HELP and TYPE comment per metric
+// name, followed by its sample lines.
+func writeSample(w *os.File, collector *usageFDCollector) error {
+	metrics, err := collector.collect()
+	if err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for _, m := range metrics {
+		if !written[m.name] {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.metricType); err != nil {
+				return fmt.Errorf("writing metric header: %w", err)
+			}
+			written[m.name] = true
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %v\n", m.name, formatLabels(m.labels), m.value); err != nil {
+			return fmt.Errorf("writing metric sample: %w", err)
+		}
+	}
+	// A blank "# EOF" marks the end of an OpenMetrics exposition, so a
+	// streaming reader can tell one sample apart from the next.
+	_, err = fmt.Fprintln(w, "# EOF")
+	return err
+}
+
+// formatLabels renders labels as an OpenMetrics label set, e.g.
+// `{device="eth0"}`, or the empty string if labels is empty.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	s := "{"
+	first := true
+	for k, v := range labels {
+		if !first {
+			s += ","
+		}
+		first = false
+		s += fmt.Sprintf("%s=%q", k, v)
+	}
+	return s + "}"
+}
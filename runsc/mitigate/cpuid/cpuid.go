@@ -0,0 +1,260 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cpuid identifies the host CPU's vendor, family/model/stepping and
+// microarchitecture directly from the CPUID instruction, rather than by
+// scraping /proc/cpuinfo. "runsc mitigate" uses its microarchitecture
+// table through Lookup, with vendor, family and model read from
+// /proc/cpuinfo; it does not call Detect.
+package cpuid
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LeafFunc reads a single CPUID leaf (and sub-leaf) and returns the four
+// result registers. It is implemented in assembly on amd64 and stubbed out
+// on other architectures; tests that need to synthesize a fake CPU
+// construct their own LeafFunc instead of calling the real instruction
+// (see runsc/mitigate/mock).
+type LeafFunc func(eax, ecx uint32) (a, b, c, d uint32)
+
+// leafFunc is an alias kept for brevity within this file.
+type leafFunc = LeafFunc
+
+// Vendor identifies the manufacturer of a CPU, as reported in the string
+// built from CPUID leaf 0's ebx/edx/ecx registers.
+type Vendor string
+
+// Known vendors.
+const (
+	VendorIntel   Vendor = "GenuineIntel"
+	VendorAMD     Vendor = "AuthenticAMD"
+	VendorUnknown Vendor = ""
+)
+
+// FeatureSet holds the subset of CPUID feature and hypervisor bits that
+// mitigate cares about, decoded from leaves 1, 7 and 0x40000000.
+type FeatureSet struct {
+	// Vendor is the CPU manufacturer.
+	Vendor Vendor
+	// Family, Model and Stepping are the values reported by CPUID leaf 1,
+	// with the family/model extension bits already folded in.
+	Family, Model, Stepping uint32
+	// HasHypervisor reports whether the hypervisor-present bit is set in
+	// leaf 1 ecx, meaning this CPUID was read from inside a VM.
+	HasHypervisor bool
+	// ArchCapabilities reports whether the CPU exposes
+	// IA32_ARCH_CAPABILITIES (leaf 7 sub-leaf 0, edx bit 29), which
+	// Intel parts use to self-report immunity to some transient
+	// execution bugs.
+	ArchCapabilities bool
+}
+
+// Microarch identifies a CPU microarchitecture, e.g. "skylake" or "zen2".
+// When the exact (vendor, family, model) of the host CPU is not in the
+// table, Detect falls back to the table entry for the same (vendor, family)
+// whose Model is numerically closest, so unknown steppings of a known
+// design still resolve to sane defaults instead of an error.
+type Microarch struct {
+	// Name is the canonical, lowercase name of the microarchitecture.
+	Name string
+	// Vendor is the manufacturer this entry applies to.
+	Vendor Vendor
+	// Family and Model identify the microarchitecture within Vendor.
+	Family, Model uint32
+	// Bugs is the set of transient-execution vulnerability names (as
+	// they appear under /sys/devices/system/cpu/vulnerabilities and in
+	// the "bugs" field of /proc/cpuinfo) that affect this design.
+	Bugs []string
+}
+
+// HasBug reports whether m is known to be affected by the named
+// vulnerability (e.g. "mds", "l1tf", "taa").
+func (m Microarch) HasBug(name string) bool {
+	for _, b := range m.Bugs {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// String implements fmt.Stringer.
+func (m Microarch) String() string {
+	return m.Name
+}
+
+// table maps (vendor, family, model) to known microarchitectures. Entries
+// are intentionally sparse: lookup falls back to the nearest Model within
+// the same (Vendor, Family) when an exact match isn't listed, mirroring how
+// archspec-style detectors resolve unknown CPUs.
+var table = []Microarch{
+	{
+		Name: "nehalem", Vendor: VendorIntel, Family: 6, Model: 26,
+		Bugs: []string{"cpu_meltdown", "spectre_v1", "spectre_v2", "spec_store_bypass", "l1tf", "mds", "swapgs"},
+	},
+	{
+		Name: "haswell", Vendor: VendorIntel, Family: 6, Model: 63,
+		Bugs: []string{"cpu_meltdown", "spectre_v1", "spectre_v2", "spec_store_bypass", "l1tf", "mds", "swapgs"},
+	},
+	{
+		Name: "skylake", Vendor: VendorIntel, Family: 6, Model: 94,
+		Bugs: []string{"cpu_meltdown", "spectre_v1", "spectre_v2", "spec_store_bypass", "l1tf", "mds", "swapgs", "mmio_stale_data"},
+	},
+	{
+		Name: "cascadelake", Vendor: VendorIntel, Family: 6, Model: 85,
+		Bugs: []string{"spectre_v1", "spectre_v2", "spec_store_bypass", "mds", "swapgs", "taa"},
+	},
+	{
+		Name: "icelake", Vendor: VendorIntel, Family: 6, Model: 106,
+		Bugs: []string{"spectre_v1", "spectre_v2", "spec_store_bypass", "swapgs", "mmio_stale_data"},
+	},
+	{
+		Name: "zen1", Vendor: VendorAMD, Family: 23, Model: 1,
+		Bugs: []string{"spectre_v1", "spectre_v2", "spec_store_bypass"},
+	},
+	{
+		Name: "zen2", Vendor: VendorAMD, Family: 23, Model: 49,
+		Bugs: []string{"spectre_v1", "spectre_v2", "spec_store_bypass"},
+	},
+	{
+		Name: "zen3", Vendor: VendorAMD, Family: 25, Model: 1,
+		Bugs: []string{"spectre_v1", "spectre_v2", "spec_store_bypass"},
+	},
+}
+
+// byName indexes table by microarchitecture name.
+func byName(name string) (Microarch, bool) {
+	for _, m := range table {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Microarch{}, false
+}
+
+// lookup finds the best match for (vendor, family, model). If the exact
+// model isn't listed, it falls back to the entry for the same (vendor,
+// family) whose Model is numerically closest, preferring the newer (higher
+// Model) entry on a tie. It returns false only when vendor/family has no
+// entry at all.
+func lookup(vendor Vendor, family, model uint32) (Microarch, bool) {
+	var best Microarch
+	var bestDist uint32
+	found := false
+	for _, m := range table {
+		if m.Vendor != vendor || m.Family != family {
+			continue
+		}
+		if m.Model == model {
+			return m, true
+		}
+		dist := modelDist(m.Model, model)
+		if !found || dist < bestDist || (dist == bestDist && m.Model > best.Model) {
+			best, bestDist, found = m, dist, true
+		}
+	}
+	return best, found
+}
+
+// modelDist returns the absolute difference between two Model values.
+func modelDist(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Lookup returns the microarchitecture table entry for (vendor, family,
+// model), for callers that already have these values from a source other
+// than a live CPUID read (e.g. parsed /proc/cpuinfo text). It applies the
+// same nearest-model fallback as Detect when the exact model isn't listed.
+func Lookup(vendor Vendor, family, model uint32) (Microarch, bool) {
+	return lookup(vendor, family, model)
+}
+
+// Detect reads the host CPU's identity via the CPUID instruction and
+// returns its microarchitecture and decoded feature set. On architectures
+// without CPUID it returns an error. "runsc mitigate" does not call it; it
+// resolves /proc/cpuinfo values with Lookup instead.
+func Detect() (Microarch, FeatureSet, error) {
+	return detect(cpuidLeaf)
+}
+
+// DetectFrom behaves like Detect, but reads CPUID leaves from leaf instead
+// of the host CPU. It exists so callers outside this package (notably the
+// mock CPUs in runsc/mitigate/mock) can synthesize a fake CPUID stream for
+// tests rather than relying on hand-formatted /proc/cpuinfo text.
+func DetectFrom(leaf LeafFunc) (Microarch, FeatureSet, error) {
+	return detect(leaf)
+}
+
+// detect is the leafFunc-parameterized implementation of Detect, split out
+// so tests can synthesize a fake CPUID stream instead of querying the real
+// hardware.
+func detect(leaf leafFunc) (Microarch, FeatureSet, error) {
+	maxLeaf, b, c, d := leaf(0, 0)
+	vendor := Vendor(decodeVendor(b, d, c))
+
+	a, _, fc, _ := leaf(1, 0)
+	fs := FeatureSet{
+		Vendor:        vendor,
+		HasHypervisor: fc&(1<<31) != 0,
+	}
+	fs.Family, fs.Model, fs.Stepping = decodeFamilyModelStepping(a)
+
+	if maxLeaf >= 7 {
+		_, _, _, d7 := leaf(7, 0)
+		fs.ArchCapabilities = d7&(1<<29) != 0
+	}
+
+	march, ok := lookup(vendor, fs.Family, fs.Model)
+	if !ok {
+		return Microarch{}, fs, fmt.Errorf("unrecognized CPU: vendor %q family %d model %d", vendor, fs.Family, fs.Model)
+	}
+	return march, fs, nil
+}
+
+// decodeVendor reassembles the 12-byte vendor ID string from the
+// ebx/edx/ecx registers returned by CPUID leaf 0, in that register order.
+func decodeVendor(b, d, c uint32) string {
+	buf := make([]byte, 0, 12)
+	for _, reg := range []uint32{b, d, c} {
+		buf = append(buf, byte(reg), byte(reg>>8), byte(reg>>16), byte(reg>>24))
+	}
+	return strings.TrimRight(string(buf), "\x00")
+}
+
+// decodeFamilyModelStepping extracts family, model and stepping from the
+// eax register of CPUID leaf 1, folding in the extended family/model bits
+// per the Intel and AMD CPUID specifications.
+func decodeFamilyModelStepping(eax uint32) (family, model, stepping uint32) {
+	baseFamily := (eax >> 8) & 0xf
+	baseModel := (eax >> 4) & 0xf
+	extFamily := (eax >> 20) & 0xff
+	extModel := (eax >> 16) & 0xf
+	stepping = eax & 0xf
+
+	family = baseFamily
+	if baseFamily == 0xf {
+		family += extFamily
+	}
+	model = baseModel
+	if baseFamily == 0x6 || baseFamily == 0xf {
+		model |= extModel << 4
+	}
+	return family, model, stepping
+}
@@ -0,0 +1,28 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build amd64
+// +build amd64
+
+package cpuid
+
+// asmCPUID executes the CPUID instruction for leaf eax / sub-leaf ecx and
+// returns the resulting eax, ebx, ecx, edx registers. Implemented in
+// cpuid_amd64.s.
+func asmCPUID(eax, ecx uint32) (a, b, c, d uint32)
+
+// cpuidLeaf is the leafFunc backed by the real CPUID instruction.
+func cpuidLeaf(eax, ecx uint32) (a, b, c, d uint32) {
+	return asmCPUID(eax, ecx)
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpuid
+
+import "testing"
+
+// fakeLeaf builds a leafFunc that reports the given vendor string and
+// family/model/stepping for leaves 0 and 1, and zero for everything else,
+// simulating a minimal CPUID stream for a single synthesized CPU.
+func fakeLeaf(vendor string, family, model, stepping uint32) leafFunc {
+	b := uint32(vendor[0]) | uint32(vendor[1])<<8 | uint32(vendor[2])<<16 | uint32(vendor[3])<<24
+	d := uint32(vendor[4]) | uint32(vendor[5])<<8 | uint32(vendor[6])<<16 | uint32(vendor[7])<<24
+	c := uint32(vendor[8]) | uint32(vendor[9])<<8 | uint32(vendor[10])<<16 | uint32(vendor[11])<<24
+
+	baseFamily, extFamily := family, uint32(0)
+	if family >= 0xf {
+		baseFamily, extFamily = 0xf, family-0xf
+	}
+	baseModel, extModel := model&0xf, model>>4
+
+	eax1 := stepping | baseFamily<<8 | baseModel<<4 | extModel<<16 | extFamily<<20
+
+	return func(eax, ecx uint32) (a, bb, cc, dd uint32) {
+		switch eax {
+		case 0:
+			return 7, b, c, d
+		case 1:
+			return eax1, 0, 0, 0
+		default:
+			return 0, 0, 0, 0
+		}
+	}
+}
+
+func TestDetectKnownMicroarch(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		vendor        string
+		family, model uint32
+		wantName      string
+	}{
+		{"CascadeLake", "GenuineIntel", 6, 85, "cascadelake"},
+		{"Haswell", "GenuineIntel", 6, 63, "haswell"},
+		{"Zen2", "AuthenticAMD", 23, 49, "zen2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			march, fs, err := detect(fakeLeaf(tc.vendor, tc.family, tc.model, 2))
+			if err != nil {
+				t.Fatalf("detect failed: %v", err)
+			}
+			if march.Name != tc.wantName {
+				t.Errorf("got microarch %q, want %q", march.Name, tc.wantName)
+			}
+			if fs.Vendor != Vendor(tc.vendor) {
+				t.Errorf("got vendor %q, want %q", fs.Vendor, tc.vendor)
+			}
+		})
+	}
+}
+
+func TestDetectUnknownSteppingFallsBackToParent(t *testing.T) {
+	// Model 200 doesn't exist for Intel family 6, but should resolve to
+	// the nearest known model (icelake, model 106) rather than the
+	// oldest table entry or an error.
+	march, _, err := detect(fakeLeaf("GenuineIntel", 6, 200, 0))
+	if err != nil {
+		t.Fatalf("detect failed: %v", err)
+	}
+	if march.Name != "icelake" {
+		t.Errorf("got microarch %q, want %q", march.Name, "icelake")
+	}
+}
+
+func TestLookupPicksNearestModel(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		model    uint32
+		wantName string
+	}{
+		// Between haswell (63) and skylake (94); haswell is closer.
+		{"BetweenHaswellAndSkylake", 70, "haswell"},
+		// Between cascadelake (85) and icelake (106); icelake is closer.
+		{"BetweenCascadeLakeAndIceLake", 100, "icelake"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			march, ok := lookup(VendorIntel, 6, tc.model)
+			if !ok {
+				t.Fatalf("lookup failed for model %d", tc.model)
+			}
+			if march.Name != tc.wantName {
+				t.Errorf("got microarch %q, want %q", march.Name, tc.wantName)
+			}
+		})
+	}
+}
+
+func TestDetectUnknownVendor(t *testing.T) {
+	if _, _, err := detect(fakeLeaf("UnknownVendor!", 6, 85, 0)); err == nil {
+		t.Error("detect succeeded for unrecognized vendor, want error")
+	}
+}
+
+func TestMicroarchHasBug(t *testing.T) {
+	cascadeLake, ok := byName("cascadelake")
+	if !ok {
+		t.Fatal("cascadelake missing from table")
+	}
+	if !cascadeLake.HasBug("mds") {
+		t.Error("cascadelake should be marked vulnerable to mds")
+	}
+	if cascadeLake.HasBug("l1tf") {
+		t.Error("cascadelake should not be marked vulnerable to l1tf")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mitigate provides functions to check the host CPU for
+// vulnerability to side channel attacks and to mitigate them.
+package mitigate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gvisor.dev/gvisor/runsc/mitigate/cpuid"
+)
+
+// knownBugs is the set of transient-execution vulnerability names that
+// mitigate recognizes in the /proc/cpuinfo "bugs" field. Only some of them
+// make a CPUSet vulnerable; see IsVulnerable.
+var knownBugs = []string{"cpu_meltdown", "spectre_v1", "spectre_v2", "spec_store_bypass", "l1tf", "mds", "swapgs", "taa", "srbds", "mmio_stale_data", "retbleed"}
+
+// cpu holds the fields of a single logical processor's entry in
+// /proc/cpuinfo that mitigate needs.
+type cpu struct {
+	processor  int
+	vendorID   string
+	family     int
+	model      int
+	modelName  string
+	physicalID int
+	coreID     int
+	cpuCores   int
+	bugs       string
+}
+
+// requiredKeys are the /proc/cpuinfo fields a cpu entry must have for
+// NewCPUSet to accept it.
+var requiredKeys = []string{"processor", "vendor_id", "cpu family", "model", "model name", "physical id", "core id", "cpu cores", "bugs"}
+
+// CPUSet is a collection of logical processors read from /proc/cpuinfo.
+type CPUSet []cpu
+
+// NewCPUSet parses data, formatted like /proc/cpuinfo, into a CPUSet.
+func NewCPUSet(data string) (CPUSet, error) {
+	blocks := strings.Split(strings.TrimSpace(data), "\n\n")
+	var set CPUSet
+	for _, block := range blocks {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		c, err := parseCPU(block)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, c)
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no cpus found for: %q", data)
+	}
+	return set, nil
+}
+
+// parseCPU parses a single /proc/cpuinfo entry (the lines for one logical
+// processor) into a cpu.
+func parseCPU(block string) (cpu, error) {
+	fields := map[string]string{}
+	for _, line := range strings.Split(block, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	for _, key := range requiredKeys {
+		if _, ok := fields[key]; !ok {
+			return cpu{}, fmt.Errorf("failed to match key %q: %q", key, block)
+		}
+	}
+
+	var c cpu
+	var err error
+	if c.processor, err = strconv.Atoi(fields["processor"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse processor: %w", err)
+	}
+	c.vendorID = fields["vendor_id"]
+	if c.family, err = strconv.Atoi(fields["cpu family"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse cpu family: %w", err)
+	}
+	if c.model, err = strconv.Atoi(fields["model"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse model: %w", err)
+	}
+	c.modelName = fields["model name"]
+	if c.physicalID, err = strconv.Atoi(fields["physical id"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse physical id: %w", err)
+	}
+	if c.coreID, err = strconv.Atoi(fields["core id"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse core id: %w", err)
+	}
+	if c.cpuCores, err = strconv.Atoi(fields["cpu cores"]); err != nil {
+		return cpu{}, fmt.Errorf("failed to parse cpu cores: %w", err)
+	}
+	c.bugs = fields["bugs"]
+	return c, nil
+}
+
+// String returns a human readable summary of the CPUSet.
+func (s CPUSet) String() string {
+	if len(s) == 0 {
+		return "no cpus"
+	}
+	return fmt.Sprintf("%d cpus, vendor %q, family %d model %d, bugs: %q", len(s), s[0].vendorID, s[0].family, s[0].model, s[0].bugs)
+}
+
+// IsVulnerable reports whether the CPUs in the set are affected by any of
+// the bugs mitigate's strategies address: l1tf, mds, taa, srbds,
+// mmio_stale_data or retbleed. Other bugs, such as the spectre variants,
+// do not make the set vulnerable.
+func (s CPUSet) IsVulnerable() bool {
+	for _, b := range s.Bugs() {
+		switch b {
+		case "l1tf", "mds", "taa", "srbds", "mmio_stale_data", "retbleed":
+			return true
+		}
+	}
+	return false
+}
+
+// Bugs returns the names of the known vulnerabilities affecting the CPUs in
+// the set. It looks up the set's own parsed vendor/family/model against
+// cpuid's microarch table, since that table is more precise than the
+// kernel-reported "bugs" field (which can lag newly discovered bugs); the
+// parsed /proc/cpuinfo "bugs" field is used as a fallback when the set's
+// (vendor, family, model) isn't in the table at all.
+func (s CPUSet) Bugs() []string {
+	if len(s) == 0 {
+		return nil
+	}
+	if march, ok := cpuid.Lookup(cpuid.Vendor(s[0].vendorID), uint32(s[0].family), uint32(s[0].model)); ok {
+		return march.Bugs
+	}
+	return s.bugsFromCPUInfo()
+}
+
+// bugsFromCPUInfo returns the list of known bugs reported in the "bugs"
+// field of the first CPU in the set.
+func (s CPUSet) bugsFromCPUInfo() []string {
+	if len(s) == 0 {
+		return nil
+	}
+	var bugs []string
+	for _, b := range strings.Fields(s[0].bugs) {
+		for _, known := range knownBugs {
+			if b == known {
+				bugs = append(bugs, b)
+			}
+		}
+	}
+	return bugs
+}
+
+// ThreadPairs groups the logical processor numbers in the set by physical
+// core (physical id + core id), returning one slice of processor numbers
+// per physical core. For a hyperthreaded core this slice has one entry per
+// sibling thread.
+func (s CPUSet) ThreadPairs() [][]int {
+	type key struct{ physicalID, coreID int }
+	order := []key{}
+	groups := map[key][]int{}
+	for _, c := range s {
+		k := key{c.physicalID, c.coreID}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], c.processor)
+	}
+	pairs := make([][]int, 0, len(order))
+	for _, k := range order {
+		pairs = append(pairs, groups[k])
+	}
+	return pairs
+}
@@ -15,7 +15,11 @@
 // Package mock contains mock CPUs for mitigate tests.
 package mock
 
-import "fmt"
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/runsc/mitigate/cpuid"
+)
 
 // CPU represents data from CPUs that will be mitigated.
 type CPU struct {
@@ -165,3 +169,32 @@ bugs		: %s
 func (tc CPU) NumCPUs() int {
 	return tc.PhysicalCores * tc.Cores * tc.ThreadsPerCore
 }
+
+// MakeCPUIDLeaf returns a cpuid.LeafFunc that answers CPUID leaves 0 and 1
+// as tc's real hardware would, so tests can exercise cpuid.DetectFrom
+// without hand-formatting /proc/cpuinfo text.
+func (tc CPU) MakeCPUIDLeaf() cpuid.LeafFunc {
+	vendor := tc.VendorID
+	b := uint32(vendor[0]) | uint32(vendor[1])<<8 | uint32(vendor[2])<<16 | uint32(vendor[3])<<24
+	d := uint32(vendor[4]) | uint32(vendor[5])<<8 | uint32(vendor[6])<<16 | uint32(vendor[7])<<24
+	c := uint32(vendor[8]) | uint32(vendor[9])<<8 | uint32(vendor[10])<<16 | uint32(vendor[11])<<24
+
+	family, model := uint32(tc.Family), uint32(tc.Model)
+	baseFamily, extFamily := family, uint32(0)
+	if family >= 0xf {
+		baseFamily, extFamily = 0xf, family-0xf
+	}
+	baseModel, extModel := model&0xf, model>>4
+	eax1 := baseFamily<<8 | baseModel<<4 | extModel<<16 | extFamily<<20
+
+	return func(eax, ecx uint32) (a, bb, cc, dd uint32) {
+		switch eax {
+		case 0:
+			return 7, b, c, d
+		case 1:
+			return eax1, 0, 0, 0
+		default:
+			return 0, 0, 0, 0
+		}
+	}
+}